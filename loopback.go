@@ -0,0 +1,16 @@
+package main
+
+import "net"
+
+// LoopbackAliaser adds and removes the secondary loopback addresses pharod
+// hands out as source addresses for forwarded connections. Ensure must be
+// idempotent: it's called every time a new address is needed, and may be
+// called again for an address that's already aliased. The concrete
+// implementation is picked per-GOOS; see loopback_darwin.go and
+// loopback_linux.go.
+type LoopbackAliaser interface {
+	Ensure(ip net.IP) error
+	Release(ip net.IP) error
+}
+
+var loopbackAliaser = newLoopbackAliaser()
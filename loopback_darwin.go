@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+// darwinIfconfig manages loopback aliases with ifconfig(8), the only way to
+// add secondary addresses to lo0 on macOS/BSD.
+type darwinIfconfig struct{}
+
+func newLoopbackAliaser() LoopbackAliaser {
+	return darwinIfconfig{}
+}
+
+func (darwinIfconfig) Ensure(ip net.IP) error {
+	cmd := exec.Command("ifconfig", "lo0", "alias", ip.String(), "up")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error calling ifconfig, adding alias for %s: %s: %s", ip, err, out)
+	}
+	return nil
+}
+
+func (darwinIfconfig) Release(ip net.IP) error {
+	cmd := exec.Command("ifconfig", "lo0", "-alias", ip.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error calling ifconfig, removing alias for %s: %s: %s", ip, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+// linuxNetlink manages loopback aliases with `ip addr`, talking to the
+// kernel over rtnetlink. This is what lets pharod run on a Linux dev box,
+// or in a sidecar container next to dockerd, where there's no ifconfig(8)
+// lo0 to alias.
+type linuxNetlink struct{}
+
+func newLoopbackAliaser() LoopbackAliaser {
+	return linuxNetlink{}
+}
+
+func (linuxNetlink) Ensure(ip net.IP) error {
+	cmd := exec.Command("ip", "addr", "add", ip.String()+"/32", "dev", "lo")
+	out, err := cmd.CombinedOutput()
+	if err != nil && !bytes.Contains(out, []byte("File exists")) {
+		return fmt.Errorf("error running 'ip addr add' for %s: %s: %s", ip, err, out)
+	}
+	return nil
+}
+
+func (linuxNetlink) Release(ip net.IP) error {
+	cmd := exec.Command("ip", "addr", "del", ip.String()+"/32", "dev", "lo")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error running 'ip addr del' for %s: %s: %s", ip, err, out)
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/d3v1an7/pharod/portallocator"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/sevlyar/go-daemon"
 	"io"
@@ -10,38 +11,154 @@ import (
 	"net"
 	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
 	"os/user"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
-var sourceAddrs map[string]map[int]*net.TCPAddr
+var stateMu sync.Mutex
+var portAllocator *portallocator.IPAllocator
+var lastLoopbackIP net.IP // only touched from mintLoopbackIP, which portAllocator serializes
 var dnsZone map[string]net.IP
-var containerListeners map[string]*Listener
-var dockerIP net.IP
+var containerListeners map[string]portListener
 var SourceStartIP = net.ParseIP("127.2.2.1")
 var firstEphemeralPort int
 
 const DnsTld = "pharod"
 
 var shouldDaemonize = flag.Bool("d", false, "run in background")
+var directRouting = flag.Bool("direct-routing", false, "also listen for every ExposedPort at <container-ip>:<private-port> on each attached network, bypassing published ports (see addDirectListeners doc comment for routing requirements)")
+var dockerHosts dockerHostFlag
 
-type Listener struct {
-	DNSName       string
-	Src           *net.TCPAddr
-	Dest          *net.TCPAddr
-	shouldStop    bool
+func init() {
+	flag.Var(&dockerHosts, "H", "Docker daemon endpoint to attach to, e.g. tcp://127.0.0.1:2375 or unix:///var/run/docker.sock (may be repeated to attach to several daemons)")
+}
+
+// dockerHostFlag collects repeated -H flags, mirroring how dockerd itself
+// accepts multiple -H addresses to listen on.
+type dockerHostFlag []string
+
+func (d *dockerHostFlag) String() string {
+	return strings.Join(*d, ",")
+}
+
+func (d *dockerHostFlag) Set(value string) error {
+	*d = append(*d, value)
+	return nil
+}
+
+// dockerEndpoint is one Docker daemon pharod is attached to. label is ""
+// when there's only a single endpoint (preserving the historical unqualified
+// DNS names), or "docker1", "docker2", ... when several -H addresses are
+// given, so DNS names and containerListeners keys from different daemons
+// don't collide.
+type dockerEndpoint struct {
+	label    string
+	host     string
+	dockerIP net.IP
+}
+
+// portListener is a running forwarder from a source address to a
+// container's port, TCP or UDP. addContainer/removeContainer only deal in
+// this interface so the two transports share a single lifecycle and a
+// single DNS/port-allocator bookkeeping path.
+type portListener interface {
+	Start()
+	Stop()
+	Wait()
+	Name() string
+	SourceIP() net.IP
+	SourcePort() int
+	Proto() string
+}
+
+// connTracker is the connection-tracking plumbing shared by the TCP and UDP
+// listeners: track starts a goroutine that owns openConnections, fed by
+// newConn/closedConn, and torn down by closeAllConns closing everything it
+// still holds open. Both a listener's Stop and its own accept/read loop
+// (once Stop closes the underlying socket out from under it) race to
+// signal teardown, so closeAllConns is closed rather than sent on, and
+// stop is guarded by stopOnce: closing an already-closed channel panics,
+// and track's select receives from closeAllConns only once before its
+// goroutine exits, so a second unguarded send could block forever with no
+// receiver left.
+type connTracker struct {
 	finished      *sync.WaitGroup
-	tcpListener   *net.TCPListener
 	newConn       chan net.Conn
 	closedConn    chan net.Conn
 	closeAllConns chan struct{}
+	stopOnce      sync.Once
+}
+
+func newConnTracker() connTracker {
+	return connTracker{
+		finished:      &sync.WaitGroup{},
+		newConn:       make(chan net.Conn),
+		closedConn:    make(chan net.Conn),
+		closeAllConns: make(chan struct{}),
+	}
 }
 
+func (self *connTracker) track() {
+	self.finished.Add(1)
+	go func() {
+		openConnections := make(map[net.Conn]bool)
+		for {
+			select {
+			case conn := <-self.newConn:
+				openConnections[conn] = true
+			case conn := <-self.closedConn:
+				delete(openConnections, conn)
+			case <-self.closeAllConns:
+				for conn, _ := range openConnections {
+					conn.Close()
+				}
+				self.finished.Done()
+				return
+			}
+		}
+	}()
+}
+
+// stop tears the tracker down, however many callers race to trigger it.
+func (self *connTracker) stop() {
+	self.stopOnce.Do(func() {
+		close(self.closeAllConns)
+	})
+}
+
+func (self *connTracker) Wait() {
+	self.finished.Wait()
+}
+
+type Listener struct {
+	DNSName string
+	Src     *net.TCPAddr
+	Dest    *net.TCPAddr
+	// ProxyProtocol is "", "v1" or "v2". When set, forward prepends a
+	// HAProxy PROXY protocol header to the connection dialled to Dest, so
+	// the backend can see the real client address instead of pharod's.
+	ProxyProtocol string
+	shouldStop    bool
+	tcpListener   *net.TCPListener
+	connTracker
+}
+
+func (self *Listener) Name() string     { return self.DNSName }
+func (self *Listener) SourceIP() net.IP { return self.Src.IP }
+func (self *Listener) SourcePort() int  { return self.Src.Port }
+func (self *Listener) Proto() string    { return "tcp" }
+
+// ProxyProtocolLabel is the container label used to opt in to PROXY
+// protocol on a listener, e.g. `pharod.proxy_protocol=v2`.
+const ProxyProtocolLabel = "pharod.proxy_protocol"
+
 func newDockerClient(host string) (client *docker.Client, err error) {
 	if os.Getenv("DOCKER_TLS_VERIFY") != "" {
 		dockerCertPath := os.Getenv("DOCKER_CERT_PATH")
@@ -63,11 +180,27 @@ func die(msg string) {
 	os.Exit(1)
 }
 
-func containerPortKey(c *docker.Container, p docker.APIPort) string {
-	return fmt.Sprintf("%s:%d", c.ID, p.PrivatePort)
+func containerPortKey(ep *dockerEndpoint, c *docker.Container, p docker.APIPort) string {
+	key := fmt.Sprintf("%s:%d", c.ID, p.PrivatePort)
+	if ep.label != "" {
+		return ep.label + "/" + key
+	}
+	return key
+}
+
+// directListenerKey is deliberately prefixed with "<cid>:" like
+// containerPortKey, just with a "direct:" tag before the network/port that
+// published-port keys never have, so removeContainer's cid-prefix match
+// tears both kinds of listener down together.
+func directListenerKey(ep *dockerEndpoint, c *docker.Container, network string, exposedPort docker.Port) string {
+	key := fmt.Sprintf("%s:direct:%s:%s", c.ID, network, exposedPort)
+	if ep.label != "" {
+		return ep.label + "/" + key
+	}
+	return key
 }
 
-func addContainer(dockerClient *docker.Client, cid string) (out []*Listener) {
+func addContainer(dockerClient *docker.Client, cid string, ep *dockerEndpoint) (out []portListener) {
 	c, err := dockerClient.InspectContainer(cid)
 	if err != nil {
 		log.Printf("Getting container info failed for id %s: %s", cid, err)
@@ -75,14 +208,17 @@ func addContainer(dockerClient *docker.Client, cid string) (out []*Listener) {
 	}
 	ports := c.NetworkSettings.PortMappingAPI()
 
-	out = make([]*Listener, 0, len(ports))
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	out = make([]portListener, 0, len(ports))
 	for _, port := range ports {
-		key := containerPortKey(c, port)
+		key := containerPortKey(ep, c, port)
 		if _, ok := containerListeners[key]; ok {
 			// already started
 			continue
 		}
-		l, err := ListenerFromContainerAndPort(c, port)
+		l, err := ListenerFromContainerAndPort(c, port, ep)
 		if err != nil {
 			log.Printf("Error creating listener for %v on container %s: %s",
 				port, c.ID, err)
@@ -90,19 +226,156 @@ func addContainer(dockerClient *docker.Client, cid string) (out []*Listener) {
 		}
 		l.Start()
 		containerListeners[key] = l
-		dnsZone[l.DNSName] = l.Src.IP
+		dnsZone[l.Name()] = l.SourceIP()
 		out = append(out, l)
 	}
+
+	if *directRouting {
+		out = append(out, addDirectListeners(c, ep)...)
+	}
+	return
+}
+
+// addDirectListeners creates a listener straight to <container-ip>:<private-port>
+// for every network the container is attached to and every port it
+// exposes, bypassing published ports entirely. That's what lets pharod
+// reach a container over a user-defined bridge/overlay network even when
+// it was never given a -p flag. Only called when -direct-routing is set,
+// since it needs pharod's host to be able to route to the container IP:
+// on Linux that means a route to the docker bridge/overlay subnet (present
+// by default only for the docker0 bridge itself; overlay and custom bridge
+// networks need one added by hand), and on macOS with Docker Desktop it
+// means the VPNKit gateway is reachable. Without that route, every direct
+// listener binds fine but every connection to it fails at dial time. Must
+// be called with stateMu held.
+func addDirectListeners(c *docker.Container, ep *dockerEndpoint) (out []portListener) {
+	if c.Config == nil || c.NetworkSettings == nil {
+		return nil
+	}
+
+	for networkName, network := range c.NetworkSettings.Networks {
+		if network == nil || network.IPAddress == "" {
+			continue
+		}
+
+		for exposedPort := range c.Config.ExposedPorts {
+			key := directListenerKey(ep, c, networkName, exposedPort)
+			if _, ok := containerListeners[key]; ok {
+				continue
+			}
+
+			l, err := directListenerFromContainer(c, networkName, network.IPAddress, exposedPort, ep)
+			if err != nil {
+				log.Printf("Error creating direct listener for %s on %s/%s: %s",
+					exposedPort, c.ID, networkName, err)
+				continue
+			}
+
+			l.Start()
+			containerListeners[key] = l
+			dnsZone[l.Name()] = l.SourceIP()
+			out = append(out, l)
+		}
+	}
 	return
 }
 
-func removeContainer(cid string) {
+// directListenerFromContainer builds the listener addDirectListeners
+// starts for one (network, exposed port) pair, with a DNS name of the form
+// <container>.<network>[.<endpoint label>].
+func directListenerFromContainer(c *docker.Container, networkName, containerIP string, exposedPort docker.Port, ep *dockerEndpoint) (portListener, error) {
+	portNum, proto, err := parseExposedPort(exposedPort)
+	if err != nil {
+		return nil, err
+	}
+
+	destIP := net.ParseIP(containerIP)
+	if destIP == nil {
+		return nil, fmt.Errorf("couldn't parse container IP '%s'", containerIP)
+	}
+
+	dnsName := dnsNameFromContainerName(c.Name)
+	if dnsName == "" {
+		return nil, fmt.Errorf("Couldn't build a non-empty DNS name from '%s'", c.Name)
+	}
+	dnsName = dnsName + "." + dnsNameFromContainerName(networkName)
+	if ep.label != "" {
+		dnsName = dnsName + "." + ep.label
+	}
+
+	if proto == "udp" {
+		dest := &net.UDPAddr{IP: destIP, Port: portNum}
+		return newUDPListener(dnsName, sourceUDPAddrForPort(portNum), dest), nil
+	}
+
+	return tcpListenerFromContainerAndPort(c, dnsName, &net.TCPAddr{IP: destIP, Port: portNum}, portNum)
+}
+
+// parseExposedPort splits a docker.Port like "80/tcp" into its port number
+// and protocol, defaulting to tcp if unspecified.
+func parseExposedPort(exposedPort docker.Port) (port int, proto string, err error) {
+	parts := strings.SplitN(string(exposedPort), "/", 2)
+	port, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("couldn't parse exposed port '%s': %v", exposedPort, err)
+	}
+
+	proto = "tcp"
+	if len(parts) == 2 && parts[1] != "" {
+		proto = parts[1]
+	}
+	return port, proto, nil
+}
+
+func removeContainer(cid string, ep *dockerEndpoint) {
+	prefix := cid + ":"
+	if ep.label != "" {
+		prefix = ep.label + "/" + prefix
+	}
+
+	// Stop is called outside stateMu below: it can block briefly closing
+	// sockets and draining goroutines, and holding the lock across that
+	// would wedge every other addContainer/removeContainer/resyncContainers
+	// on the same endpoint (or others) until it returns.
+	var toStop []portListener
+
+	stateMu.Lock()
 	for cp, l := range containerListeners {
-		if strings.HasPrefix(cp, cid+":") {
+		if strings.HasPrefix(cp, prefix) {
 			delete(containerListeners, cp)
-			delete(dnsZone, l.DNSName)
-			delete(sourceAddrs[l.Src.IP.String()], l.Src.Port)
-			l.Stop()
+			delete(dnsZone, l.Name())
+
+			portAllocator.Release(l.Proto(), l.SourceIP(), l.SourcePort())
+			if portAllocator.IPIsFree(l.SourceIP()) {
+				if err := loopbackAliaser.Release(l.SourceIP()); err != nil {
+					log.Printf("Error releasing loopback alias %s: %s", l.SourceIP(), err)
+				}
+				// Forget the IP along with its alias: otherwise a later
+				// ReserveAny would keep handing this now-unaliased IP back
+				// without ever re-Ensure-ing it, and the next ListenTCP on
+				// it would panic.
+				portAllocator.RemoveIP(l.SourceIP())
+			}
+
+			toStop = append(toStop, l)
+		}
+	}
+	stateMu.Unlock()
+
+	for _, l := range toStop {
+		l.Stop()
+	}
+}
+
+// releaseAllAliases tears down every loopback alias pharod has allocated,
+// so a clean shutdown doesn't leave them behind for the next run.
+func releaseAllAliases() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	for _, ip := range portAllocator.IPs() {
+		if err := loopbackAliaser.Release(ip); err != nil {
+			log.Printf("Error releasing loopback alias %s: %s", ip, err)
 		}
 	}
 }
@@ -142,29 +415,28 @@ func main() {
 		die(err.Error())
 	}
 
-	dockerHost := os.Getenv("DOCKER_HOST")
-	if dockerHost == "" {
-		die("DOCKER_HOST not set")
+	if len(dockerHosts) == 0 {
+		if envHost := os.Getenv("DOCKER_HOST"); envHost != "" {
+			dockerHosts = append(dockerHosts, envHost)
+		}
+	}
+	if len(dockerHosts) == 0 {
+		die("DOCKER_HOST not set (or pass -H tcp://host:port / -H unix:///var/run/docker.sock, may be repeated)")
 	}
 
-	dockerIpStr := os.Getenv("DOCKER_HOST_IP")
-	if dockerIpStr == "" {
-		dockerHostUrl, err := url.Parse(dockerHost)
+	endpoints := make([]*dockerEndpoint, 0, len(dockerHosts))
+	for i, host := range dockerHosts {
+		ip, err := dockerIPForHost(host)
 		if err != nil {
-			die(fmt.Sprintf("Couldn't parse DOCKER_HOST URL: %v", err))
+			die(fmt.Sprintf("Couldn't determine docker daemon IP for '%s': %v", host, err))
 		}
-		dockerIpStr, _, err = net.SplitHostPort(dockerHostUrl.Host)
-		if err != nil {
-			die(err.Error())
+		label := ""
+		if len(dockerHosts) > 1 {
+			label = fmt.Sprintf("docker%d", i+1)
 		}
+		endpoints = append(endpoints, &dockerEndpoint{label: label, host: host, dockerIP: ip})
 	}
 
-	dockerIpAddr, err := net.ResolveIPAddr("ip", dockerIpStr)
-	if err != nil {
-		die(fmt.Sprintf("'%s' couldn't be resolved: %v", dockerIpStr, err))
-	}
-	dockerIP = dockerIpAddr.IP
-
 	if *shouldDaemonize {
 		arg0 := os.Args[0]
 		if arg0 == "" {
@@ -195,41 +467,236 @@ func main() {
 
 	log.Println("** Starting Pharod")
 
-	dockerClient, err := newDockerClient(dockerHost)
-	if err != nil {
-		die(err.Error())
-	}
-
 	dnsZone = make(map[string]net.IP, 0)
-	containerListeners = make(map[string]*Listener)
-	sourceAddrs = make(map[string]map[int]*net.TCPAddr)
+	containerListeners = make(map[string]portListener)
+	portAllocator = portallocator.New(mintLoopbackIP)
 
 	go startDns()
 	go startAPI()
 
-	dockerEvents := make(chan *docker.APIEvents)
-	err = dockerClient.AddEventListener(dockerEvents)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		log.Println("** Shutting down, releasing loopback aliases")
+		releaseAllAliases()
+		os.Exit(0)
+	}()
+
+	var wg sync.WaitGroup
+	for _, ep := range endpoints {
+		wg.Add(1)
+		go runDockerEndpoint(ep, &wg)
+	}
+	wg.Wait()
+}
+
+// dockerIPForHost works out the IP pharod should dial to reach ports
+// published on the given DOCKER_HOST-style endpoint. DOCKER_HOST_IP always
+// wins if set; otherwise a tcp:// endpoint's host is resolved, and a
+// unix:// endpoint (talking to a daemon on this machine) defaults to the
+// loopback address.
+func dockerIPForHost(host string) (net.IP, error) {
+	if dockerIpStr := os.Getenv("DOCKER_HOST_IP"); dockerIpStr != "" {
+		dockerIpAddr, err := net.ResolveIPAddr("ip", dockerIpStr)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' couldn't be resolved: %v", dockerIpStr, err)
+		}
+		return dockerIpAddr.IP, nil
+	}
+
+	dockerHostUrl, err := url.Parse(host)
 	if err != nil {
-		die(err.Error())
+		return nil, fmt.Errorf("couldn't parse DOCKER_HOST URL: %v", err)
 	}
 
-	containers, err := dockerClient.ListContainers(docker.ListContainersOptions{})
+	switch dockerHostUrl.Scheme {
+	case "unix":
+		return net.ParseIP("127.0.0.1"), nil
+	case "tcp", "":
+		dockerIpStr, _, err := net.SplitHostPort(dockerHostUrl.Host)
+		if err != nil {
+			return nil, err
+		}
+		dockerIpAddr, err := net.ResolveIPAddr("ip", dockerIpStr)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' couldn't be resolved: %v", dockerIpStr, err)
+		}
+		return dockerIpAddr.IP, nil
+	default:
+		return nil, fmt.Errorf("unsupported DOCKER_HOST scheme '%s'", dockerHostUrl.Scheme)
+	}
+}
+
+const (
+	reconnectInitialBackoff = 1 * time.Second
+	reconnectMaxBackoff     = 30 * time.Second
+)
+
+// endpointStatus is the connection state of one Docker daemon pharod is
+// attached to, as recorded by runDockerEndpoint and connectAndFollow.
+type endpointStatus struct {
+	Connected bool
+	LastError string
+}
+
+var endpointStatusMu sync.Mutex
+var endpointStatuses = map[string]*endpointStatus{}
+
+func endpointStatusKey(ep *dockerEndpoint) string {
+	if ep.label != "" {
+		return ep.label
+	}
+	return ep.host
+}
+
+func setEndpointStatus(ep *dockerEndpoint, connected bool, err error) {
+	endpointStatusMu.Lock()
+	defer endpointStatusMu.Unlock()
+
+	status := &endpointStatus{Connected: connected}
 	if err != nil {
-		die(err.Error())
+		status.LastError = err.Error()
+	}
+	endpointStatuses[endpointStatusKey(ep)] = status
+}
+
+// EndpointStatuses returns a snapshot of every docker endpoint's current
+// connection state, keyed by label (or host, for the single-endpoint
+// case). Nothing calls it: the HTTP API started by startAPI does not
+// expose endpoint state.
+func EndpointStatuses() map[string]endpointStatus {
+	endpointStatusMu.Lock()
+	defer endpointStatusMu.Unlock()
+
+	out := make(map[string]endpointStatus, len(endpointStatuses))
+	for k, v := range endpointStatuses {
+		out[k] = *v
 	}
+	return out
+}
 
-	for _, c := range containers {
-		addContainer(dockerClient, c.ID)
+// runDockerEndpoint keeps ep's listeners in sync with its Docker daemon for
+// the lifetime of the process: it reconnects with exponential backoff
+// whenever the event stream drops, resyncing against ListContainers on
+// every successful reconnect so listeners for containers that came and
+// went while disconnected don't go stale.
+func runDockerEndpoint(ep *dockerEndpoint, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	backoff := reconnectInitialBackoff
+	for {
+		connected, err := connectAndFollow(ep)
+		setEndpointStatus(ep, false, err)
+		if err != nil {
+			log.Printf("[%s] disconnected: %s (reconnecting in %s)", ep.host, err, backoff)
+		} else {
+			log.Printf("[%s] event stream closed (reconnecting in %s)", ep.host, backoff)
+		}
+
+		if connected {
+			backoff = reconnectInitialBackoff
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+// connectAndFollow connects to ep's daemon, resyncs containerListeners
+// against its current container list, then follows its event stream until
+// the channel closes or a read fails. connected reports whether it got far
+// enough to resync and follow events at all, so the caller can reset its
+// backoff instead of growing it for a daemon that connects fine but
+// quickly drops.
+func connectAndFollow(ep *dockerEndpoint) (connected bool, err error) {
+	dockerClient, err := newDockerClient(ep.host)
+	if err != nil {
+		return false, fmt.Errorf("couldn't create docker client: %s", err)
 	}
 
+	dockerEvents := make(chan *docker.APIEvents)
+	if err := dockerClient.AddEventListener(dockerEvents); err != nil {
+		return false, fmt.Errorf("couldn't listen for docker events: %s", err)
+	}
+
+	if err := resyncContainers(dockerClient, ep); err != nil {
+		return false, fmt.Errorf("couldn't resync containers: %s", err)
+	}
+
+	setEndpointStatus(ep, true, nil)
+	log.Printf("[%s] connected", ep.host)
+
 	for ev := range dockerEvents {
 		switch ev.Status {
 		case "start", "unpause":
-			addContainer(dockerClient, ev.ID)
+			addContainer(dockerClient, ev.ID, ep)
 		case "stop", "pause", "die":
-			removeContainer(ev.ID)
+			removeContainer(ev.ID, ep)
 		}
 	}
+
+	return true, nil
+}
+
+// resyncContainers reconciles containerListeners for ep against the
+// daemon's current container list: it adds listeners for anything running
+// that pharod doesn't know about yet, and tears down listeners for
+// anything pharod still thinks is running that has vanished, e.g. while
+// disconnected from the daemon.
+func resyncContainers(dockerClient *docker.Client, ep *dockerEndpoint) error {
+	containers, err := dockerClient.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		return err
+	}
+
+	running := make(map[string]bool, len(containers))
+	for _, c := range containers {
+		running[c.ID] = true
+		addContainer(dockerClient, c.ID, ep)
+	}
+
+	for _, cid := range knownContainerIDs(ep) {
+		if !running[cid] {
+			removeContainer(cid, ep)
+		}
+	}
+	return nil
+}
+
+// knownContainerIDs returns the distinct container IDs ep currently has
+// listeners for, derived from containerListeners' keys.
+func knownContainerIDs(ep *dockerEndpoint) []string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	prefix := ""
+	if ep.label != "" {
+		prefix = ep.label + "/"
+	}
+
+	seen := make(map[string]bool)
+	var ids []string
+	for key := range containerListeners {
+		if ep.label != "" {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			key = strings.TrimPrefix(key, prefix)
+		} else if strings.Contains(strings.SplitN(key, ":", 2)[0], "/") {
+			continue // belongs to a labelled endpoint
+		}
+
+		cid := strings.SplitN(key, ":", 2)[0]
+		if !seen[cid] {
+			seen[cid] = true
+			ids = append(ids, cid)
+		}
+	}
+	return ids
 }
 
 func succIP(ip net.IP) net.IP {
@@ -251,57 +718,53 @@ func ipToInt(ip net.IP) uint32 {
 		(uint32(ip[14]) << 8) | uint32(ip[15])
 }
 
-func sourceAddrForPort(port int, dest *net.TCPAddr) *net.TCPAddr {
-	getSourceAddr := func(addr string) *net.TCPAddr {
-		src, err := net.ResolveTCPAddr("tcp",
-			fmt.Sprintf("%s:%d", addr, port))
-		if err != nil {
-			panic(err)
-		}
-		return src
-	}
-
-	var lastAddr string
-	var lastAddrIP net.IP
-	for addr, ls := range sourceAddrs {
-		addrIP := net.ParseIP(addr)
-		if lastAddrIP == nil || ipToInt(addrIP) > ipToInt(lastAddrIP) {
-			lastAddr = addr
-			lastAddrIP = addrIP
-		}
-		if _, ok := ls[port]; !ok {
-			ls[port] = dest
-			return getSourceAddr(addr)
-		}
-	}
-
+// mintLoopbackIP is portAllocator's NewIP callback: it's only ever invoked
+// while portAllocator's own lock is held, so walking/updating
+// lastLoopbackIP here needs no locking of its own.
+func mintLoopbackIP() (net.IP, error) {
 	var nextIP net.IP
-	if lastAddr == "" {
+	if lastLoopbackIP == nil {
 		nextIP = SourceStartIP
 	} else {
-		lastAddrIP := net.ParseIP(lastAddr)
-		if lastAddrIP == nil {
-			panic("lastAddr not an IP address")
-		}
-		nextIP = succIP(lastAddrIP)
+		nextIP = succIP(lastLoopbackIP)
 	}
 
 	if !nextIP.IsLoopback() {
-		panic("ran out of loopback addresses!")
+		return nil, fmt.Errorf("ran out of loopback addresses!")
 	}
 
-	addr := nextIP.String()
-	ifconfig := exec.Command("ifconfig", "lo0", "alias", addr, "up")
-	if err := ifconfig.Run(); err != nil {
-		panic(fmt.Sprintf(
-			"error calling ifconfig, adding alias for %s: %s",
-			addr, err))
+	if err := loopbackAliaser.Ensure(nextIP); err != nil {
+		return nil, err
 	}
 
-	sourceAddrs[addr] = map[int]*net.TCPAddr{
-		port: dest,
+	lastLoopbackIP = nextIP
+	return nextIP, nil
+}
+
+func sourceAddrForPort(port int) *net.TCPAddr {
+	ip, err := portAllocator.ReserveAny("tcp", port)
+	if err != nil {
+		panic(err)
 	}
-	return getSourceAddr(addr)
+
+	src, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", ip, port))
+	if err != nil {
+		panic(err)
+	}
+	return src
+}
+
+func sourceUDPAddrForPort(port int) *net.UDPAddr {
+	ip, err := portAllocator.ReserveAny("udp", port)
+	if err != nil {
+		panic(err)
+	}
+
+	src, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", ip, port))
+	if err != nil {
+		panic(err)
+	}
+	return src
 }
 
 var dnsNameAllowedChars = regexp.MustCompile(`[^-a-z0-9.]+`)
@@ -313,7 +776,7 @@ func dnsNameFromContainerName(containerName string) string {
 			containerName, "-"), "-"), "-")
 }
 
-func ListenerFromContainerAndPort(container *docker.Container, port docker.APIPort) (out *Listener, err error) {
+func ListenerFromContainerAndPort(container *docker.Container, port docker.APIPort, ep *dockerEndpoint) (out portListener, err error) {
 
 	if container.Name == "" {
 		return nil, fmt.Errorf("Container %s has no name from which to build a DNS name", container.ID)
@@ -324,30 +787,23 @@ func ListenerFromContainerAndPort(container *docker.Container, port docker.APIPo
 			port.PublicPort, container.Name)
 	}
 
-	out = &Listener{
-		finished:      &sync.WaitGroup{},
-		newConn:       make(chan net.Conn),
-		closedConn:    make(chan net.Conn),
-		closeAllConns: make(chan struct{}),
-	}
-
-	out.DNSName = dnsNameFromContainerName(container.Name)
-	if out.DNSName == "" {
+	dnsName := dnsNameFromContainerName(container.Name)
+	if dnsName == "" {
 		return nil, fmt.Errorf("Couldn't build a non-empty DNS name from '%s'", container.Name)
 	}
+	if ep.label != "" {
+		dnsName = dnsName + "." + ep.label
+	}
 
 	destIPAddr, err := net.ResolveIPAddr("ip", port.IP)
 	if err != nil {
-		return
+		return nil, err
 	}
-	out.Dest = new(net.TCPAddr)
-	if destIPAddr.IP.IsUnspecified() {
-		out.Dest.IP = dockerIP
-	} else {
-		out.Dest.IP = destIPAddr.IP
+	destIP := destIPAddr.IP
+	if destIP.IsUnspecified() {
+		destIP = ep.dockerIP
 	}
-	out.Dest.Port = int(port.PublicPort)
-	out.Dest.Zone = destIPAddr.Zone
+	destPort := int(port.PublicPort)
 
 	var srcPort int
 	/* If destination is an ephemeral port, we want to listen on the original
@@ -355,13 +811,41 @@ func ListenerFromContainerAndPort(container *docker.Container, port docker.APIPo
 	 * not, we want to listen on the same port as we're forwarding to, as that
 	 * means the user has exposed a different port on the host.
 	 */
-	if out.Dest.Port >= firstEphemeralPort {
+	if destPort >= firstEphemeralPort {
 		srcPort = int(port.PrivatePort)
 	} else {
-		srcPort = out.Dest.Port
+		srcPort = destPort
 	}
-	out.Src = sourceAddrForPort(srcPort, out.Dest)
-	return
+
+	if port.Type == "udp" {
+		dest := &net.UDPAddr{IP: destIP, Port: destPort, Zone: destIPAddr.Zone}
+		return newUDPListener(dnsName, sourceUDPAddrForPort(srcPort), dest), nil
+	}
+
+	return tcpListenerFromContainerAndPort(container, dnsName,
+		&net.TCPAddr{IP: destIP, Port: destPort, Zone: destIPAddr.Zone}, srcPort)
+}
+
+func tcpListenerFromContainerAndPort(container *docker.Container, dnsName string, dest *net.TCPAddr, srcPort int) (portListener, error) {
+	out := &Listener{
+		connTracker: newConnTracker(),
+		DNSName:     dnsName,
+		Dest:        dest,
+	}
+
+	if container.Config != nil {
+		if v, ok := container.Config.Labels[ProxyProtocolLabel]; ok {
+			switch v {
+			case "v1", "v2":
+				out.ProxyProtocol = v
+			default:
+				log.Printf("Ignoring unknown %s value %q on %s", ProxyProtocolLabel, v, container.Name)
+			}
+		}
+	}
+
+	out.Src = sourceAddrForPort(srcPort)
+	return out, nil
 }
 
 func (self *Listener) Start() {
@@ -372,32 +856,14 @@ func (self *Listener) Start() {
 		panic(err)
 	}
 
-	self.finished.Add(1)
-
-	go func() {
-		openConnections := make(map[net.Conn]bool)
-		for {
-			select {
-			case conn := <-self.newConn:
-				openConnections[conn] = true
-			case conn := <-self.closedConn:
-				delete(openConnections, conn)
-			case _ = <-self.closeAllConns:
-				for conn, _ := range openConnections {
-					conn.Close()
-				}
-				self.finished.Done()
-				return
-			}
-		}
-	}()
+	self.track()
 
 	go func() {
 		for {
 			conn, err := self.tcpListener.Accept()
 			if err != nil {
 				log.Printf("Shutting down listener on %s", self.DNSName)
-				self.closeAllConns <- struct{}{}
+				self.stop()
 				return
 			}
 
@@ -412,14 +878,10 @@ func (self *Listener) Stop() {
 	if self.tcpListener != nil {
 		log.Printf("Stopping listener on %s", self.DNSName)
 		self.tcpListener.Close()
-		self.closeAllConns <- struct{}{}
+		self.stop()
 	}
 }
 
-func (self *Listener) Wait() {
-	self.finished.Wait()
-}
-
 func (self *Listener) forward(local net.Conn) {
 
 	remote, err := net.DialTCP("tcp", nil, self.Dest)
@@ -428,6 +890,17 @@ func (self *Listener) forward(local net.Conn) {
 		return
 	}
 
+	if self.ProxyProtocol != "" {
+		if clientAddr, ok := local.RemoteAddr().(*net.TCPAddr); ok {
+			header, err := proxyProtocolHeader(self.ProxyProtocol, clientAddr, self.Src)
+			if err != nil {
+				log.Printf("Error building PROXY protocol header for %s: %v", self.DNSName, err)
+			} else if _, err := remote.Write(header); err != nil {
+				log.Printf("Error writing PROXY protocol header for %s: %v", self.DNSName, err)
+			}
+		}
+	}
+
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 	self.finished.Add(2)
@@ -0,0 +1,215 @@
+// Package portallocator tracks which ports are in use on each of a set of
+// loopback IPs, modeled on moby's libnetwork/portallocator. It replaces a
+// linear scan over pharod's source addresses with a per-IP bitmap, and only
+// asks for a new IP once every existing one is saturated for the requested
+// port.
+package portallocator
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+const numPorts = 1 << 16
+
+// portBitmap tracks which of the 65536 possible ports are reserved.
+type portBitmap [numPorts / 64]uint64
+
+func (b *portBitmap) isSet(port int) bool {
+	return b[port/64]&(1<<uint(port%64)) != 0
+}
+
+func (b *portBitmap) set(port int) {
+	b[port/64] |= 1 << uint(port%64)
+}
+
+func (b *portBitmap) clear(port int) {
+	b[port/64] &^= 1 << uint(port%64)
+}
+
+func (b *portBitmap) empty() bool {
+	for _, word := range b {
+		if word != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// IPAllocator reserves ports across a growable set of IPs. NewIP is called
+// to mint a new IP whenever ReserveAny finds every existing IP already
+// holding the requested port; it's normally wired up to allocate and alias
+// a fresh loopback address.
+//
+// Reservations are tracked per protocol, keyed by "proto/ip", so the same
+// port can be reserved for TCP and UDP on the same IP independently (as
+// happens whenever a container exposes the same port number for both).
+type IPAllocator struct {
+	mu    sync.Mutex
+	ips   []net.IP
+	ports map[string]*portBitmap
+	NewIP func() (net.IP, error)
+}
+
+// New creates an empty IPAllocator. newIP is used by ReserveAny to obtain a
+// new IP once every IP it already knows about is saturated for the
+// requested port; it may be nil if the caller only ever uses Reserve with
+// IPs it manages itself.
+func New(newIP func() (net.IP, error)) *IPAllocator {
+	return &IPAllocator{
+		ports: make(map[string]*portBitmap),
+		NewIP: newIP,
+	}
+}
+
+func checkPort(port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("port %d out of range", port)
+	}
+	return nil
+}
+
+// bitmapKey namespaces a portBitmap by protocol, so e.g. "tcp/127.0.0.2" and
+// "udp/127.0.0.2" are tracked independently.
+func bitmapKey(proto string, ip net.IP) string {
+	return proto + "/" + ip.String()
+}
+
+func (a *IPAllocator) knownIP(ip net.IP) bool {
+	for _, known := range a.ips {
+		if known.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reserve marks port as in use on ip for proto ("tcp" or "udp"),
+// registering ip with the allocator if it hasn't been seen before. It
+// fails if the port is already reserved on that IP for that protocol.
+func (a *IPAllocator) Reserve(proto string, ip net.IP, port int) error {
+	if err := checkPort(port); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reserveLocked(proto, ip, port)
+}
+
+func (a *IPAllocator) reserveLocked(proto string, ip net.IP, port int) error {
+	key := bitmapKey(proto, ip)
+	bitmap, ok := a.ports[key]
+	if !ok {
+		bitmap = &portBitmap{}
+		a.ports[key] = bitmap
+	}
+	if !a.knownIP(ip) {
+		a.ips = append(a.ips, ip)
+	}
+
+	if bitmap.isSet(port) {
+		return fmt.Errorf("port %d already reserved on %s", port, key)
+	}
+	bitmap.set(port)
+	return nil
+}
+
+// ReserveAny reserves port for proto on the first known IP that doesn't
+// already have it reserved for that protocol, allocating a new IP via
+// NewIP only once every existing one is saturated for that port.
+func (a *IPAllocator) ReserveAny(proto string, port int) (net.IP, error) {
+	if err := checkPort(port); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, ip := range a.ips {
+		key := bitmapKey(proto, ip)
+		bitmap, ok := a.ports[key]
+		if !ok {
+			bitmap = &portBitmap{}
+			a.ports[key] = bitmap
+		}
+		if !bitmap.isSet(port) {
+			bitmap.set(port)
+			return ip, nil
+		}
+	}
+
+	if a.NewIP == nil {
+		return nil, fmt.Errorf("no IP free for port %d, and no way to allocate another", port)
+	}
+	ip, err := a.NewIP()
+	if err != nil {
+		return nil, err
+	}
+	if err := a.reserveLocked(proto, ip, port); err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+// Release frees port on ip for proto so it can be reserved again.
+func (a *IPAllocator) Release(proto string, ip net.IP, port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if bitmap, ok := a.ports[bitmapKey(proto, ip)]; ok {
+		bitmap.clear(port)
+	}
+}
+
+// IPIsFree reports whether ip currently has no ports reserved on it in any
+// protocol, so callers can decide whether it's safe to release the
+// underlying loopback alias.
+func (a *IPAllocator) IPIsFree(ip net.IP) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	suffix := "/" + ip.String()
+	for key, bitmap := range a.ports {
+		if strings.HasSuffix(key, suffix) && !bitmap.empty() {
+			return false
+		}
+	}
+	return true
+}
+
+// IPs returns every IP the allocator knows about, in the order they were
+// first seen.
+func (a *IPAllocator) IPs() []net.IP {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	out := make([]net.IP, len(a.ips))
+	copy(out, a.ips)
+	return out
+}
+
+// RemoveIP forgets ip entirely. Callers that tear down the underlying
+// loopback alias once an IP is free (IPIsFree) must also call RemoveIP, or
+// a later ReserveAny will keep handing that IP back without ever calling
+// NewIP to re-alias it.
+func (a *IPAllocator) RemoveIP(ip net.IP) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	suffix := "/" + ip.String()
+	for key := range a.ports {
+		if strings.HasSuffix(key, suffix) {
+			delete(a.ports, key)
+		}
+	}
+
+	for i, known := range a.ips {
+		if known.Equal(ip) {
+			a.ips = append(a.ips[:i], a.ips[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package portallocator
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func ip(n byte) net.IP {
+	return net.IPv4(127, 0, 0, n)
+}
+
+func TestReserveAndDoubleReserve(t *testing.T) {
+	a := New(nil)
+
+	if err := a.Reserve("tcp", ip(1), 8080); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if err := a.Reserve("tcp", ip(1), 8080); err == nil {
+		t.Fatal("expected double-reserve of the same ip:port to fail")
+	}
+	if err := a.Reserve("tcp", ip(2), 8080); err != nil {
+		t.Fatalf("Reserve on a different ip should succeed: %v", err)
+	}
+}
+
+func TestReserveAnyExhaustsThenAllocatesNewIP(t *testing.T) {
+	var minted []net.IP
+	next := byte(1)
+	a := New(func() (net.IP, error) {
+		next++
+		newIP := ip(next)
+		minted = append(minted, newIP)
+		return newIP, nil
+	})
+
+	first := ip(1)
+	if err := a.Reserve("tcp", first, 80); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+
+	got, err := a.ReserveAny("tcp", 80)
+	if err != nil {
+		t.Fatalf("ReserveAny failed: %v", err)
+	}
+	if got.Equal(first) {
+		t.Fatalf("ReserveAny should have minted a new IP once %s was saturated for port 80", first)
+	}
+	if len(minted) != 1 {
+		t.Fatalf("expected exactly one new IP to be minted, got %d", len(minted))
+	}
+}
+
+func TestReserveAnyFailsWithoutNewIPWhenExhausted(t *testing.T) {
+	a := New(nil)
+	if err := a.Reserve("tcp", ip(1), 80); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+
+	if _, err := a.ReserveAny("tcp", 80); err == nil {
+		t.Fatal("expected ReserveAny to fail once exhausted with no NewIP callback")
+	}
+}
+
+func TestReleaseAllowsReuse(t *testing.T) {
+	a := New(nil)
+	addr := ip(1)
+
+	if err := a.Reserve("tcp", addr, 80); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if a.IPIsFree(addr) {
+		t.Fatal("ip should not be free while a port is reserved")
+	}
+
+	a.Release("tcp", addr, 80)
+	if !a.IPIsFree(addr) {
+		t.Fatal("ip should be free once its only reserved port is released")
+	}
+
+	if err := a.Reserve("tcp", addr, 80); err != nil {
+		t.Fatalf("expected released port to be reservable again: %v", err)
+	}
+}
+
+func TestCheckPortRejectsOutOfRange(t *testing.T) {
+	a := New(nil)
+	for _, port := range []int{0, -1, 65536, 100000} {
+		if err := a.Reserve("tcp", ip(1), port); err == nil {
+			t.Fatalf("expected Reserve(%d) to fail", port)
+		}
+		if _, err := a.ReserveAny("tcp", port); err == nil {
+			t.Fatalf("expected ReserveAny(%d) to fail", port)
+		}
+	}
+}
+
+func TestReserveAnyPrefersEarliestKnownIP(t *testing.T) {
+	a := New(func() (net.IP, error) {
+		return nil, fmt.Errorf("should not need a new IP")
+	})
+
+	if err := a.Reserve("tcp", ip(1), 80); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if err := a.Reserve("tcp", ip(2), 443); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+
+	got, err := a.ReserveAny("tcp", 443)
+	if err != nil {
+		t.Fatalf("ReserveAny failed: %v", err)
+	}
+	if !got.Equal(ip(1)) {
+		t.Fatalf("expected port 443 to be reserved on %s, got %s", ip(1), got)
+	}
+}
+
+func TestTCPAndUDPReservationsAreIndependent(t *testing.T) {
+	a := New(func() (net.IP, error) {
+		return nil, fmt.Errorf("should not need a new IP")
+	})
+	addr := ip(1)
+
+	if err := a.Reserve("tcp", addr, 53); err != nil {
+		t.Fatalf("tcp Reserve failed: %v", err)
+	}
+	if err := a.Reserve("udp", addr, 53); err != nil {
+		t.Fatalf("udp Reserve of the same ip:port should succeed independently of tcp: %v", err)
+	}
+	if err := a.Reserve("udp", addr, 53); err == nil {
+		t.Fatal("expected double-reserve of the same proto:ip:port to fail")
+	}
+
+	if a.IPIsFree(addr) {
+		t.Fatal("ip should not be free while either protocol still holds a port")
+	}
+
+	a.Release("tcp", addr, 53)
+	if a.IPIsFree(addr) {
+		t.Fatal("ip should not be free while udp still holds its reservation")
+	}
+
+	a.Release("udp", addr, 53)
+	if !a.IPIsFree(addr) {
+		t.Fatal("ip should be free once both protocols have released their reservations")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// proxyProtocolV2Signature is the fixed 12-byte prefix that marks a v2
+// PROXY protocol header, per the spec at
+// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+var proxyProtocolV2Signature = []byte{
+	0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+}
+
+// proxyProtocolHeader builds a PROXY protocol header describing a TCP
+// connection from src to dst, for prepending to a forwarded connection so
+// the backend sees the real client address instead of pharod's.
+func proxyProtocolHeader(version string, src, dst *net.TCPAddr) ([]byte, error) {
+	switch version {
+	case "v1":
+		return proxyProtocolV1Header(src, dst), nil
+	case "v2":
+		return proxyProtocolV2Header(src, dst), nil
+	default:
+		return nil, fmt.Errorf("unknown PROXY protocol version %q", version)
+	}
+}
+
+func proxyProtocolV1Header(src, dst *net.TCPAddr) []byte {
+	family := "TCP4"
+	if src.IP.To4() == nil {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		family, src.IP, dst.IP, src.Port, dst.Port))
+}
+
+func proxyProtocolV2Header(src, dst *net.TCPAddr) []byte {
+	var addrFamily byte
+	var addrBytes []byte
+	if srcIP4, dstIP4 := src.IP.To4(), dst.IP.To4(); srcIP4 != nil && dstIP4 != nil {
+		addrFamily = 0x11 // TCP over IPv4
+		addrBytes = append(append([]byte{}, srcIP4...), dstIP4...)
+	} else {
+		addrFamily = 0x21 // TCP over IPv6
+		addrBytes = append(append([]byte{}, src.IP.To16()...), dst.IP.To16()...)
+	}
+
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(dst.Port))
+	body := append(addrBytes, ports...)
+
+	header := make([]byte, 0, len(proxyProtocolV2Signature)+4+len(body))
+	header = append(header, proxyProtocolV2Signature...)
+	header = append(header, 0x21) // version 2, command PROXY
+	header = append(header, addrFamily)
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(body)))
+	header = append(header, length...)
+	header = append(header, body...)
+
+	return header
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpClientIdleTimeout is how long a per-client UDP session is kept open
+// with no traffic before it's reaped, so long-lived pharod processes don't
+// accumulate dead sessions for clients that never come back (DNS, syslog,
+// StatsD, QUIC, ...).
+const udpClientIdleTimeout = 60 * time.Second
+
+// udpListener forwards UDP datagrams the same way Listener forwards TCP
+// connections, one *net.UDPConn per client remote address dialled to Dest,
+// reaped after udpClientIdleTimeout of inactivity.
+type udpListener struct {
+	DNSName string
+	Src     *net.UDPAddr
+	Dest    *net.UDPAddr
+
+	udpConn *net.UDPConn
+
+	clientsMu sync.Mutex
+	clients   map[string]*net.UDPConn
+
+	connTracker
+}
+
+func newUDPListener(dnsName string, src, dest *net.UDPAddr) *udpListener {
+	return &udpListener{
+		DNSName:     dnsName,
+		Src:         src,
+		Dest:        dest,
+		clients:     make(map[string]*net.UDPConn),
+		connTracker: newConnTracker(),
+	}
+}
+
+func (self *udpListener) Name() string     { return self.DNSName }
+func (self *udpListener) SourceIP() net.IP { return self.Src.IP }
+func (self *udpListener) SourcePort() int  { return self.Src.Port }
+func (self *udpListener) Proto() string    { return "udp" }
+
+func (self *udpListener) Start() {
+	log.Printf("Started UDP listener on %s; listening: %v; dialling: %v", self.DNSName, *self.Src, *self.Dest)
+	var err error
+	self.udpConn, err = net.ListenUDP("udp", self.Src)
+	if err != nil {
+		panic(err)
+	}
+
+	self.track()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, clientAddr, err := self.udpConn.ReadFromUDP(buf)
+			if err != nil {
+				log.Printf("Shutting down UDP listener on %s", self.DNSName)
+				self.stop()
+				return
+			}
+
+			payload := make([]byte, n)
+			copy(payload, buf[:n])
+			self.forward(clientAddr, payload)
+		}
+	}()
+}
+
+func (self *udpListener) Stop() {
+	if self.udpConn != nil {
+		log.Printf("Stopping UDP listener on %s", self.DNSName)
+		self.udpConn.Close()
+		self.stop()
+	}
+}
+
+// forward writes payload, received from clientAddr, to the container,
+// reusing (or creating) the *net.UDPConn dedicated to that client.
+func (self *udpListener) forward(clientAddr *net.UDPAddr, payload []byte) {
+	conn, err := self.connForClient(clientAddr)
+	if err != nil {
+		log.Printf("UDP dial to %v failed: %v\n", self.Dest, err)
+		return
+	}
+
+	if _, err := conn.Write(payload); err != nil {
+		log.Printf("UDP write to %v failed: %v\n", self.Dest, err)
+		return
+	}
+	// Traffic from the client counts as activity too, not just replies.
+	conn.SetReadDeadline(time.Now().Add(udpClientIdleTimeout))
+}
+
+func (self *udpListener) connForClient(clientAddr *net.UDPAddr) (*net.UDPConn, error) {
+	key := clientAddr.String()
+
+	self.clientsMu.Lock()
+	defer self.clientsMu.Unlock()
+
+	if conn, ok := self.clients[key]; ok {
+		return conn, nil
+	}
+
+	conn, err := net.DialUDP("udp", nil, self.Dest)
+	if err != nil {
+		return nil, err
+	}
+	self.clients[key] = conn
+	self.newConn <- conn
+
+	go self.readReplies(clientAddr, key, conn)
+
+	return conn, nil
+}
+
+// readReplies copies datagrams the container sends back on conn to the
+// original client, until conn goes idle for udpClientIdleTimeout or is
+// closed out from under it by Stop.
+func (self *udpListener) readReplies(clientAddr *net.UDPAddr, key string, conn *net.UDPConn) {
+	buf := make([]byte, 65535)
+	for {
+		conn.SetReadDeadline(time.Now().Add(udpClientIdleTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			self.clientsMu.Lock()
+			delete(self.clients, key)
+			self.clientsMu.Unlock()
+			conn.Close()
+			select {
+			case self.closedConn <- conn:
+			case <-self.closeAllConns:
+			}
+			return
+		}
+		self.udpConn.WriteToUDP(buf[:n], clientAddr)
+	}
+}